@@ -0,0 +1,47 @@
+package file
+
+import (
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+)
+
+// ErrChecksumMismatch is returned from a DecompressReadMode FileHandle's Read once the
+// decompressed body has been fully consumed and its CRC32 doesn't match the one stored in the
+// header, indicating the stored body was corrupted or tampered with. Files written before the
+// Checksum field existed carry none, so reads of those never produce this error.
+var ErrChecksumMismatch = fmt.Errorf("file: decompressed body failed checksum verification")
+
+// checksumReadCloser wraps a decompressing reader, accumulating a CRC32 over the decompressed
+// bytes as they're read. On EOF it compares the accumulated checksum against the one stored in
+// the header, surfacing a mismatch as ErrChecksumMismatch. This mirrors how archive/zip validates
+// CRC32 at the end of each file member, without needing a separate sidecar.
+type checksumReadCloser struct {
+	r        io.ReadCloser
+	hasher   hash.Hash32
+	expected uint32
+	verified bool
+}
+
+func newChecksumReadCloser(r io.ReadCloser, expected uint32) *checksumReadCloser {
+	return &checksumReadCloser{r: r, hasher: crc32.NewIEEE(), expected: expected}
+}
+
+func (c *checksumReadCloser) Read(p []byte) (n int, err error) {
+	n, err = c.r.Read(p)
+	if n > 0 {
+		c.hasher.Write(p[:n])
+	}
+	if err == io.EOF && !c.verified {
+		c.verified = true
+		if c.hasher.Sum32() != c.expected {
+			return n, ErrChecksumMismatch
+		}
+	}
+	return
+}
+
+func (c *checksumReadCloser) Close() error {
+	return c.r.Close()
+}
@@ -4,13 +4,55 @@ import (
 	"bytes"
 	"compress/gzip"
 	"fmt"
+	"hash/crc32"
 	"io"
-	"math/rand"
 	"time"
 )
 
 func init() {
-	rand.Seed(time.Now().UnixNano())
+	RegisterCompressor(MethodGzip, func(w io.Writer) io.WriteCloser { return gzip.NewWriter(w) })
+	RegisterDecompressor(MethodGzip, func(r io.Reader) io.ReadCloser {
+		decompress, err := gzip.NewReader(r)
+		if err != nil {
+			panic(err)
+		}
+		return decompress
+	})
+}
+
+// Compression method identifiers stored in FileHeader.Method. Only MethodGzip has a codec
+// registered out of the box; the others have none until one is passed to
+// RegisterCompressor/RegisterDecompressor. Values above 128 are reserved for user-registered codecs.
+const (
+	MethodStore   uint8 = 0
+	MethodGzip    uint8 = 1
+	MethodZstd    uint8 = 2
+	MethodDeflate uint8 = 3
+)
+
+// Constructs a streaming compressor that writes its compressed output to w.
+type CompressorFunc func(w io.Writer) io.WriteCloser
+
+// Constructs a streaming decompressor that reads compressed input from r.
+type DecompressorFunc func(r io.Reader) io.ReadCloser
+
+var (
+	compressors   = map[uint8]CompressorFunc{}
+	decompressors = map[uint8]DecompressorFunc{}
+)
+
+// Registers (or overrides) the compressor used by WriteFile for the given Method.
+// Following archive/zip's RegisterCompressor, this is expected to be called from an init
+// function, and is not safe to call concurrently with WriteFile.
+func RegisterCompressor(method uint8, fn CompressorFunc) {
+	compressors[method] = fn
+}
+
+// Registers (or overrides) the decompressor used by FileHandle for the given Method.
+// Following archive/zip's RegisterDecompressor, this is expected to be called from an init
+// function, and is not safe to call concurrently with SetReadMode.
+func RegisterDecompressor(method uint8, fn DecompressorFunc) {
+	decompressors[method] = fn
 }
 
 // The header of a saved file
@@ -21,9 +63,32 @@ type FileHeader struct {
 	// The index of the API Key which was used to do this upload.
 	// This is only really useful to the application which has the array of API keys
 	ApiKeyID uint8
+	// Which codec compressed the body (see MethodGzip, etc). Files written before this field
+	// existed don't carry it on disk; ReadFileHeader fills it in as MethodGzip for those.
+	Method uint8
+	// Whether the body is password-protected (see WriteEncryptedFile/OpenEncrypted). Zero value
+	// (EncryptionNone) means the body is plain compressed data, same as before this field existed.
+	Encryption EncryptionMethod
 	// the mimetype and original name of the file for the browser.
 	// These are simply provided values, and may not accurately reflect reality
 	MimeType, OriginalName string
+	// CRC32 (IEEE) of the original, decompressed payload, as written by WriteFile and
+	// WriteEncryptedFile. ParallelWriteFile writes the header before it has read the body (so
+	// writing can start streaming immediately), so it has no way to know the checksum in time to
+	// include it, and never sets this field. Only meaningful when hasChecksum is set; files
+	// written before this field existed, or via ParallelWriteFile, carry none, and
+	// DecompressReadMode skips verification for those.
+	Checksum uint32
+
+	// Populated by WriteEncryptedFile/ReadFileHeader when Encryption != EncryptionNone; unused
+	// otherwise. Fixed-size so FileHeader stays comparable with ==. Not meant to be set directly -
+	// WriteEncryptedFile derives and fills these in.
+	encSalt [16]byte
+	encPWV  [pwvLength]byte
+	encTag  [macTagLength]byte
+	// Whether Checksum was actually computed and stored on disk. Not meant to be set directly -
+	// WriteFile/WriteEncryptedFile/ReadFileHeader derive it.
+	hasChecksum bool
 }
 
 // A file that has been opened and can be read.
@@ -31,13 +96,21 @@ type FileHeader struct {
 type FileHandle struct {
 	// The loaded header
 	Header FileHeader
-	// This could be a decompressed reader, or it could be nil.
+	// This could be a decompressing reader, or it could be nil.
 	// It's set when SetReadMode is called with DecompressReadMode
-	decompressSource *gzip.Reader
+	decompressSource io.ReadCloser
 	// The reader for the remainder of the file. This is the raw compressed data from the file.
 	rawSource io.Reader
 	// The source we're currently reading from. This points to either rawSource or decompressSource
 	currentSource io.Reader
+	// Set when the handle was opened with ReadFileAt; lets Seek and BodySection reach into the
+	// raw body by offset instead of only streaming forward through rawSource.
+	bodySection *io.SectionReader
+	// Set once Read has pulled any bytes out of currentSource, in either read mode, or once
+	// SetReadMode has built a decompressor over rawSource (which may read ahead from it). OpenRaw uses
+	// this to refuse to hand out a reader that's already missing its leading bytes, since
+	// rawSource can't otherwise be told apart from one that's still at the start of the body.
+	consumed bool
 }
 
 type ReadMode uint8
@@ -54,11 +127,17 @@ func (handle *FileHandle) SetReadMode(mode ReadMode) {
 	switch mode {
 	case DecompressReadMode:
 		if handle.decompressSource == nil {
-			decompress, err := gzip.NewReader(handle.rawSource)
-			if err != nil {
-				panic(err)
+			newDecompressor, ok := decompressors[handle.Header.Method]
+			if !ok {
+				panic(fmt.Sprintf("no decompressor registered for method %d", handle.Header.Method))
+			}
+			decompressed := newDecompressor(handle.rawSource)
+			if handle.Header.hasChecksum {
+				decompressed = newChecksumReadCloser(decompressed, handle.Header.Checksum)
 			}
-			handle.decompressSource = decompress
+			handle.decompressSource = decompressed
+			// Building the decompressor may already have read ahead from rawSource.
+			handle.consumed = true
 		}
 		handle.currentSource = handle.decompressSource
 	case RawReadMode:
@@ -70,7 +149,9 @@ func (handle *FileHandle) SetReadMode(mode ReadMode) {
 
 // Closes the readers and performs other i/o cleanup
 func (handle *FileHandle) Close() error {
-	handle.decompressSource.Close()
+	if handle.decompressSource != nil {
+		handle.decompressSource.Close()
+	}
 	if cls, ok := handle.rawSource.(io.Closer); ok {
 		return cls.Close()
 	}
@@ -81,7 +162,11 @@ func (handle *FileHandle) Close() error {
 // This will read bytes into the passed array, returning the number of bytes read and or an error
 // this implements io.Reader
 func (handle *FileHandle) Read(bytes []byte) (n int, err error) {
-	return handle.currentSource.Read(bytes)
+	n, err = handle.currentSource.Read(bytes)
+	if n > 0 {
+		handle.consumed = true
+	}
+	return
 }
 
 // This will write into the writer, all of the bytes from this file based on SetReadMode
@@ -91,6 +176,33 @@ func (handle *FileHandle) WriteTo(w io.Writer) (n int64, err error) {
 	return io.Copy(w, handle)
 }
 
+// Returns a reader over the raw, still-compressed body of this file, exactly as it sits on disk.
+// This is the same underlying reader used by RawReadMode, exposed directly so that callers like
+// CopyFile can re-host the file elsewhere without paying for a decompress/recompress round trip.
+//
+// Returns an error if bytes have already been pulled out of the body (by Read in either read mode,
+// or by the decompressor that SetReadMode(DecompressReadMode) builds) and the handle can't be
+// rewound: a handle opened via ReadFileAt rewinds its SectionReader-backed
+// body automatically, since BodySection makes that cheap and safe, but any other handle is a
+// forward-only stream with no way to give back bytes it's already consumed.
+func (handle *FileHandle) OpenRaw() (io.Reader, error) {
+	if handle.consumed {
+		if handle.bodySection == nil {
+			return nil, fmt.Errorf("file: OpenRaw: body has already been read from and this handle cannot be rewound (open it with ReadFileAt to allow rewinding)")
+		}
+		if _, err := handle.bodySection.Seek(0, io.SeekStart); err != nil {
+			return nil, err
+		}
+		handle.consumed = false
+	}
+	raw := handle.rawSource
+	if decrypting, ok := raw.(*decryptingReader); ok {
+		// OpenEncrypted wraps rawSource to decrypt it; hand out the ciphertext underneath.
+		raw = decrypting.src
+	}
+	return raw, nil
+}
+
 // Writes to the provided writer, using metadata from the "FileHeader" using the file contained in
 // the io.Reader src; so the call is something like this -> WriteFile(destination, info, sourceFile)
 //
@@ -100,7 +212,99 @@ func WriteFile(dst io.Writer, info FileHeader, src io.Reader) (nWritten int, err
 		err = fmt.Errorf("you must provide a non nil dst and src")
 		return
 	}
-	n, err := dst.Write([]byte{0xFA, 0xFA})
+
+	if info.Encryption != EncryptionNone {
+		err = fmt.Errorf("use WriteEncryptedFile to write a FileHeader with Encryption set")
+		return
+	}
+
+	newCompressor, ok := compressors[info.Method]
+	if !ok {
+		err = fmt.Errorf("no compressor registered for method %d", info.Method)
+		return
+	}
+
+	hasher := crc32.NewIEEE()
+	var compressed bytes.Buffer
+	compressionWriter := newCompressor(&compressed)
+	if _, err = io.Copy(compressionWriter, io.TeeReader(src, hasher)); err != nil {
+		return
+	}
+	if err = compressionWriter.Close(); err != nil {
+		return
+	}
+	info.Checksum = hasher.Sum32()
+	info.hasChecksum = true
+
+	n, err := writeHeader(dst, info)
+	if err != nil {
+		return
+	}
+	nWritten = n
+
+	n, err = dst.Write(compressed.Bytes())
+	if err != nil {
+		return
+	}
+	nWritten += n
+	return
+}
+
+// Copies a stored file to a new destination without touching the compressed body: the header is
+// re-serialized with the same fields (see writeHeader for how the magic's version byte is picked)
+// and the raw (still-gzipped) payload is re-emitted as-is. The caller may mutate handle.Header
+// beforehand (e.g. to override UploadDate, OriginalName or MimeType) before calling CopyFile; the
+// body itself is streamed straight from handle.OpenRaw() so merging/mirroring a file never pays
+// for a decompress+recompress pass.
+//
+// Fails with OpenRaw's error if handle has already had bytes read out of it and can't be rewound
+// (see OpenRaw) - CopyFile needs the body from its first byte, so a handle opened via ReadFileAt
+// and read from is rewound automatically, but any other partially-read handle is rejected rather
+// than silently emitting a truncated body.
+func CopyFile(dst io.Writer, handle *FileHandle) (nWritten int, err error) {
+	if dst == nil || handle == nil {
+		err = fmt.Errorf("you must provide a non nil dst and handle")
+		return
+	}
+
+	raw, err := handle.OpenRaw()
+	if err != nil {
+		return
+	}
+
+	n, err := writeHeader(dst, handle.Header)
+	if err != nil {
+		return
+	}
+	nWritten += n
+
+	n64, err := io.Copy(dst, raw)
+	if err != nil {
+		return
+	}
+	nWritten += int(n64)
+	return
+}
+
+// Serializes the 0xFA-prefixed magic and a FileHeader to dst, returning the number of bytes
+// written. Shared by WriteFile/WriteEncryptedFile (which follow it with a freshly
+// compressed/encrypted body) and CopyFile (which follows it with a raw, already-compressed body).
+//
+// The second magic byte picks the lowest version that covers everything info actually carries, so
+// that CopyFile re-emits exactly the fields its source header had rather than fabricating a
+// checksum or encryption extras that were never computed for it. See ReadFileHeader for what each
+// version adds.
+func writeHeader(dst io.Writer, info FileHeader) (nWritten int, err error) {
+	version := byte(0xFA)
+	switch {
+	case info.hasChecksum:
+		version = 0xFD
+	case info.Encryption != EncryptionNone:
+		version = 0xFC
+	case info.Method != MethodGzip:
+		version = 0xFB
+	}
+	n, err := dst.Write([]byte{0xFA, version})
 	if err != nil {
 		return
 	}
@@ -115,6 +319,32 @@ func WriteFile(dst io.Writer, info FileHeader, src io.Reader) (nWritten int, err
 	if err != nil {
 		return
 	}
+	if version >= 0xFB {
+		err = headerBuffer.WriteByte(info.Method)
+		if err != nil {
+			return
+		}
+	}
+	if version >= 0xFC {
+		err = headerBuffer.WriteByte(byte(info.Encryption))
+		if err != nil {
+			return
+		}
+		if info.Encryption != EncryptionNone {
+			_, err = headerBuffer.Write(info.encSalt[:info.Encryption.saltLen()])
+			if err != nil {
+				return
+			}
+			_, err = headerBuffer.Write(info.encPWV[:])
+			if err != nil {
+				return
+			}
+			_, err = headerBuffer.Write(info.encTag[:])
+			if err != nil {
+				return
+			}
+		}
+	}
 	_, err = writeLengthPrefixedString(info.MimeType, &headerBuffer)
 	if err != nil {
 		return
@@ -123,6 +353,12 @@ func WriteFile(dst io.Writer, info FileHeader, src io.Reader) (nWritten int, err
 	if err != nil {
 		return
 	}
+	if info.hasChecksum {
+		_, err = writeNumber(uint(info.Checksum), 4, &headerBuffer)
+		if err != nil {
+			return
+		}
+	}
 
 	headLength := headerBuffer.Len()
 	n64, err := writeNumber(uint(headLength), 2, dst)
@@ -135,22 +371,16 @@ func WriteFile(dst io.Writer, info FileHeader, src io.Reader) (nWritten int, err
 		return
 	}
 	nWritten += int(n64)
-	if err != nil {
-		return
-	}
-
-	compressionWriter := gzip.NewWriter(dst)
-	defer compressionWriter.Close()
-	defer compressionWriter.Flush()
-	n64, err = io.Copy(compressionWriter, src)
-	if err != nil {
-		return
-	}
-	nWritten += int(n64)
 	return
 }
 
 // Reads just the header from a source, and returns it in the struct, as well as the number of bytes read, and the error
+//
+// The second magic byte is a version indicator, each version carrying everything the previous one
+// did plus one more field: 0xFA is the original header (always gzip, no encryption, no checksum),
+// 0xFB adds a Method byte after ApiKeyID, 0xFC adds an Encryption byte (and, if set, the
+// encryption salt/PWV/MAC tag) after Method, and 0xFD adds a CRC32 checksum of the decompressed
+// payload after OriginalName.
 func ReadFileHeader(src io.Reader) (header FileHeader, nRead int, err error) {
 	twoBytes := make([]byte, 2)
 	n, err := src.Read(twoBytes)
@@ -158,21 +388,26 @@ func ReadFileHeader(src io.Reader) (header FileHeader, nRead int, err error) {
 		return
 	}
 	nRead += n
-	if twoBytes[0] != twoBytes[1] && twoBytes[0] != 0xFA {
-		err = fmt.Errorf("file does not begin with header 0xFAFA")
+	if twoBytes[0] != 0xFA || (twoBytes[1] != 0xFA && twoBytes[1] != 0xFB && twoBytes[1] != 0xFC && twoBytes[1] != 0xFD) {
+		err = fmt.Errorf("file does not begin with header 0xFAFA, 0xFAFB, 0xFAFC or 0xFAFD")
 		return
 	}
+	hasMethod := twoBytes[1] >= 0xFB
+	hasEncryption := twoBytes[1] >= 0xFC
+	hasChecksum := twoBytes[1] == 0xFD
 
 	headerLength, err := readNumber(2, src)
 	if err != nil {
 		return
 	}
+	nRead += 2
 	headerBytes := make([]byte, headerLength)
 
-	n, err = src.Read(headerBytes)
+	n, err = io.ReadFull(src, headerBytes)
 	if err != nil {
 		return
 	}
+	nRead += n
 
 	headerBuf := bytes.NewBuffer(headerBytes)
 	secondsTime, err := readNumber(5, headerBuf)
@@ -184,6 +419,33 @@ func ReadFileHeader(src io.Reader) (header FileHeader, nRead int, err error) {
 	if err != nil {
 		return
 	}
+	if hasMethod {
+		header.Method, err = headerBuf.ReadByte()
+		if err != nil {
+			return
+		}
+	} else {
+		header.Method = MethodGzip
+	}
+	if hasEncryption {
+		var encByte byte
+		encByte, err = headerBuf.ReadByte()
+		if err != nil {
+			return
+		}
+		header.Encryption = EncryptionMethod(encByte)
+		if header.Encryption != EncryptionNone {
+			if _, err = io.ReadFull(headerBuf, header.encSalt[:header.Encryption.saltLen()]); err != nil {
+				return
+			}
+			if _, err = io.ReadFull(headerBuf, header.encPWV[:]); err != nil {
+				return
+			}
+			if _, err = io.ReadFull(headerBuf, header.encTag[:]); err != nil {
+				return
+			}
+		}
+	}
 	header.MimeType, _, err = readLengthPrefixedString(headerBuf)
 	if err != nil {
 		return
@@ -192,6 +454,15 @@ func ReadFileHeader(src io.Reader) (header FileHeader, nRead int, err error) {
 	if err != nil {
 		return
 	}
+	if hasChecksum {
+		var checksum uint64
+		checksum, err = readNumber(4, headerBuf)
+		if err != nil {
+			return
+		}
+		header.Checksum = uint32(checksum)
+		header.hasChecksum = true
+	}
 	return
 }
 
@@ -212,17 +483,48 @@ func ReadFile(src io.Reader) (handle *FileHandle, err error) {
 	return
 }
 
-const charset = "abcdefghkmnoprstwxzABCDEFGHJKLMNPQRTWXY34689"
+// Reads a file from a io.ReaderAt of known size, exposing the compressed body as a seekable
+// io.SectionReader (see BodySection/Seek) instead of only a forward-only io.Reader. This unlocks
+// HTTP range serving of the underlying payload, and on-disk caching of just the body, without
+// buffering the whole file upfront.
+func ReadFileAt(r io.ReaderAt, size int64) (handle *FileHandle, err error) {
+	if r == nil {
+		err = fmt.Errorf("you need to provide a non nil reader")
+		return
+	}
 
-// Returns a random string that's good for human URLs.
-func CreateRandomFileName(length int) string {
-	if length <= 0 {
-		return ""
+	header, headerLen, err := ReadFileHeader(io.NewSectionReader(r, 0, size))
+	if err != nil {
+		return
 	}
 
-	return string([]rune(charset)[rand.Intn(len(charset))]) + CreateRandomFileName(length-1)
+	bodySection := io.NewSectionReader(r, int64(headerLen), size-int64(headerLen))
+	handle = &FileHandle{Header: header, rawSource: bodySection, bodySection: bodySection}
+	handle.SetReadMode(RawReadMode)
+	return
+}
+
+// Returns the raw, still-compressed body of a file opened via ReadFileAt as a seekable
+// io.SectionReader (header-stripped). Returns nil for handles opened any other way.
+func (handle *FileHandle) BodySection() *io.SectionReader {
+	return handle.bodySection
 }
 
+// Seeks within the file's raw compressed body. Only supported in RawReadMode, and only for
+// handles opened via ReadFileAt, so that HTTP handlers can honor Range requests against the
+// compressed representation directly when a client sends Accept-Encoding: gzip.
+func (handle *FileHandle) Seek(offset int64, whence int) (int64, error) {
+	if handle.bodySection == nil {
+		return 0, fmt.Errorf("file: Seek requires a handle opened with ReadFileAt")
+	}
+	if handle.currentSource != handle.rawSource {
+		return 0, fmt.Errorf("file: Seek is only supported in RawReadMode")
+	}
+	return handle.bodySection.Seek(offset, whence)
+}
+
+const charset = "abcdefghkmnoprstwxzABCDEFGHJKLMNPQRTWXY34689"
+
 func writeNumber(number uint, byteCount int, out io.Writer) (n int64, err error) {
 	var buffer bytes.Buffer
 	for i := 0; i < byteCount; i++ {
@@ -3,15 +3,23 @@ package file
 import (
 	"bytes"
 	"fmt"
+	"hash/crc32"
 	"io"
 	"io/ioutil"
 	"os"
 	"regexp"
+	"runtime"
 	"testing"
 	"time"
 )
 
-var testFileHeader = FileHeader{time.Unix(1481834107, 0), uint8(1), "image/png", "Screenshot at todo"}
+var testFileHeader = FileHeader{
+	UploadDate:   time.Unix(1481834107, 0),
+	ApiKeyID:     uint8(1),
+	Method:       MethodGzip,
+	MimeType:     "image/png",
+	OriginalName: "Screenshot at todo",
+}
 
 func TestRead(t *testing.T) {
 	target, err := os.Open("test_data/encoded")
@@ -41,6 +49,381 @@ func TestWrite(t *testing.T) {
 	checkAgainstReal(t, &buffer, "encoded")
 }
 
+func TestCopyFile(t *testing.T) {
+	target, err := os.Open("test_data/encoded")
+	if err != nil {
+		t.Error(err)
+	}
+	handle, err := ReadFile(target)
+	if err != nil {
+		t.Error(err)
+	}
+
+	var buffer bytes.Buffer
+	_, err = CopyFile(&buffer, handle)
+	if err != nil {
+		t.Error(err)
+	}
+	checkAgainstReal(t, &buffer, "encoded")
+}
+
+func TestCopyFileRejectsPartiallyReadHandle(t *testing.T) {
+	var encodedBuf bytes.Buffer
+	if _, err := WriteFile(&encodedBuf, testFileHeader, bytes.NewBufferString("hello there")); err != nil {
+		t.Error(err)
+	}
+
+	handle, err := ReadFile(bytes.NewReader(encodedBuf.Bytes()))
+	if err != nil {
+		t.Error(err)
+	}
+	handle.SetReadMode(DecompressReadMode)
+	partial := make([]byte, 3)
+	if _, err = io.ReadFull(handle, partial); err != nil {
+		t.Error(err)
+	}
+
+	var out bytes.Buffer
+	if _, err = CopyFile(&out, handle); err == nil {
+		t.Error("CopyFile should refuse a handle that's already been partially read and can't be rewound")
+	}
+}
+
+func TestCopyFileRewindsReadFileAtHandle(t *testing.T) {
+	var encodedBuf bytes.Buffer
+	if _, err := WriteFile(&encodedBuf, testFileHeader, bytes.NewBufferString("hello there")); err != nil {
+		t.Error(err)
+	}
+	encoded := encodedBuf.Bytes()
+
+	handle, err := ReadFileAt(bytes.NewReader(encoded), int64(len(encoded)))
+	if err != nil {
+		t.Error(err)
+	}
+	if _, err = handle.Seek(0, io.SeekStart); err != nil {
+		t.Error(err)
+	}
+	handle.SetReadMode(DecompressReadMode)
+	partial := make([]byte, 3)
+	if _, err = io.ReadFull(handle, partial); err != nil {
+		t.Error(err)
+	}
+
+	var out bytes.Buffer
+	if _, err = CopyFile(&out, handle); err != nil {
+		t.Error("CopyFile should rewind a ReadFileAt handle's body automatically:", err)
+	}
+
+	roundTripped, err := ReadFile(bytes.NewReader(out.Bytes()))
+	if err != nil {
+		t.Error(err)
+	}
+	roundTripped.SetReadMode(DecompressReadMode)
+	data, err := ioutil.ReadAll(roundTripped)
+	if err != nil {
+		t.Error(err)
+	}
+	if string(data) != "hello there" {
+		t.Error("decompressed contents did not round-trip through CopyFile after a rewind:", string(data))
+	}
+}
+
+func TestRegisteredCodec(t *testing.T) {
+	const methodUpper uint8 = 200
+	RegisterCompressor(methodUpper, func(w io.Writer) io.WriteCloser {
+		return upperWriter{w}
+	})
+	RegisterDecompressor(methodUpper, func(r io.Reader) io.ReadCloser {
+		return ioutil.NopCloser(r)
+	})
+
+	header := testFileHeader
+	header.Method = methodUpper
+
+	var buffer bytes.Buffer
+	_, err := WriteFile(&buffer, header, bytes.NewBufferString("hello"))
+	if err != nil {
+		t.Error(err)
+	}
+
+	handle, err := ReadFile(&buffer)
+	if err != nil {
+		t.Error(err)
+	}
+	if handle.Header.Method != methodUpper {
+		t.Error("method was not round-tripped through the header")
+	}
+	handle.SetReadMode(RawReadMode)
+	raw, err := ioutil.ReadAll(handle)
+	if err != nil {
+		t.Error(err)
+	}
+	if string(raw) != "HELLO" {
+		t.Error("custom codec was not used to write the body:", string(raw))
+	}
+}
+
+// upperWriter is a trivial io.WriteCloser used to exercise RegisterCompressor without a real codec.
+type upperWriter struct {
+	w io.Writer
+}
+
+func (u upperWriter) Write(p []byte) (int, error) {
+	upper := bytes.ToUpper(p)
+	return u.w.Write(upper)
+}
+
+func (u upperWriter) Close() error {
+	return nil
+}
+
+func TestEncryptedRoundTrip(t *testing.T) {
+	header := testFileHeader
+	header.Encryption = EncryptionAES256
+	password := []byte("correct horse battery staple")
+
+	var buffer bytes.Buffer
+	_, err := WriteEncryptedFile(&buffer, header, bytes.NewBufferString("secret contents"), password)
+	if err != nil {
+		t.Error(err)
+	}
+
+	handle, err := OpenEncrypted(bytes.NewReader(buffer.Bytes()), password)
+	if err != nil {
+		t.Error(err)
+	}
+	if !handle.Header.hasChecksum || handle.Header.Checksum != crc32.ChecksumIEEE([]byte("secret contents")) {
+		t.Error("WriteEncryptedFile did not store the checksum of the decompressed payload")
+	}
+	handle.SetReadMode(DecompressReadMode)
+	data, err := ioutil.ReadAll(handle)
+	if err != nil {
+		t.Error(err)
+	}
+	if string(data) != "secret contents" {
+		t.Error("decrypted contents did not round-trip:", string(data))
+	}
+
+	if _, err = OpenEncrypted(bytes.NewReader(buffer.Bytes()), []byte("wrong password")); err == nil {
+		t.Error("no error when opening with the wrong password")
+	}
+}
+
+func TestEncryptedTamperedCiphertext(t *testing.T) {
+	header := testFileHeader
+	header.Encryption = EncryptionAES256
+	password := []byte("correct horse battery staple")
+
+	var buffer bytes.Buffer
+	if _, err := WriteEncryptedFile(&buffer, header, bytes.NewBufferString("secret contents"), password); err != nil {
+		t.Error(err)
+	}
+	encoded := buffer.Bytes()
+	encoded[len(encoded)-1] ^= 0xFF // corrupt the last byte of ciphertext, leaving the stored tag intact
+
+	handle, err := OpenEncrypted(bytes.NewReader(encoded), password)
+	if err != nil {
+		t.Error(err)
+	}
+	if _, err = ioutil.ReadAll(handle); err != ErrMACMismatch {
+		t.Error("expected ErrMACMismatch from tampered ciphertext, got:", err)
+	}
+}
+
+func TestWriteFileRejectsEncryption(t *testing.T) {
+	header := testFileHeader
+	header.Encryption = EncryptionAES128
+	var buffer bytes.Buffer
+	if _, err := WriteFile(&buffer, header, bytes.NewBufferString("x")); err == nil {
+		t.Error("WriteFile should reject a FileHeader with Encryption set")
+	}
+}
+
+func TestReadFileAt(t *testing.T) {
+	var buffer bytes.Buffer
+	if _, err := WriteFile(&buffer, testFileHeader, bytes.NewBufferString("hello there")); err != nil {
+		t.Error(err)
+	}
+	encoded := buffer.Bytes()
+
+	handle, err := ReadFileAt(bytes.NewReader(encoded), int64(len(encoded)))
+	if err != nil {
+		t.Error(err)
+	}
+	wantHeader := testFileHeader
+	wantHeader.Checksum = crc32.ChecksumIEEE([]byte("hello there"))
+	wantHeader.hasChecksum = true
+	if handle.Header != wantHeader {
+		t.Error("header does not match")
+	}
+
+	section := handle.BodySection()
+	if section == nil {
+		t.Error("BodySection returned nil for a handle opened with ReadFileAt")
+	}
+	if _, err = handle.Seek(0, io.SeekStart); err != nil {
+		t.Error(err)
+	}
+	handle.SetReadMode(DecompressReadMode)
+	data, err := ioutil.ReadAll(handle)
+	if err != nil {
+		t.Error(err)
+	}
+	if string(data) != "hello there" {
+		t.Error("decompressed contents did not round-trip:", string(data))
+	}
+}
+
+func TestReadFileAtCloseWithoutDecompressing(t *testing.T) {
+	var buffer bytes.Buffer
+	if _, err := WriteFile(&buffer, testFileHeader, bytes.NewBufferString("hello there")); err != nil {
+		t.Error(err)
+	}
+	encoded := buffer.Bytes()
+
+	handle, err := ReadFileAt(bytes.NewReader(encoded), int64(len(encoded)))
+	if err != nil {
+		t.Error(err)
+	}
+	if _, err = handle.Seek(0, io.SeekStart); err != nil {
+		t.Error(err)
+	}
+	if _, err = ioutil.ReadAll(handle); err != nil {
+		t.Error(err)
+	}
+	if err = handle.Close(); err != nil {
+		t.Error("Close should not fail on a handle that never called SetReadMode(DecompressReadMode):", err)
+	}
+}
+
+func TestChecksumRoundTrip(t *testing.T) {
+	var buffer bytes.Buffer
+	if _, err := WriteFile(&buffer, testFileHeader, bytes.NewBufferString("hello there")); err != nil {
+		t.Error(err)
+	}
+	encoded := buffer.Bytes()
+
+	handle, err := ReadFile(bytes.NewReader(encoded))
+	if err != nil {
+		t.Error(err)
+	}
+	if !handle.Header.hasChecksum || handle.Header.Checksum != crc32.ChecksumIEEE([]byte("hello there")) {
+		t.Error("WriteFile did not store the checksum of the decompressed payload")
+	}
+
+	handle.SetReadMode(DecompressReadMode)
+	data, err := ioutil.ReadAll(handle)
+	if err != nil {
+		t.Error(err)
+	}
+	if string(data) != "hello there" {
+		t.Error("decompressed contents did not round-trip:", string(data))
+	}
+}
+
+func TestChecksumMismatch(t *testing.T) {
+	var buffer bytes.Buffer
+	if _, err := WriteFile(&buffer, testFileHeader, bytes.NewBufferString("hello there")); err != nil {
+		t.Error(err)
+	}
+	encoded := buffer.Bytes()
+
+	_, headerLen, err := ReadFileHeader(bytes.NewReader(encoded))
+	if err != nil {
+		t.Error(err)
+	}
+	encoded[headerLen-1] ^= 0xFF // corrupt the stored checksum itself, leaving the gzip body intact
+
+	handle, err := ReadFile(bytes.NewReader(encoded))
+	if err != nil {
+		t.Error(err)
+	}
+	handle.SetReadMode(DecompressReadMode)
+	if _, err = ioutil.ReadAll(handle); err != ErrChecksumMismatch {
+		t.Error("expected ErrChecksumMismatch from a corrupted stored checksum, got:", err)
+	}
+}
+
+func TestParallelWriteFile(t *testing.T) {
+	source := bytes.Repeat([]byte("the quick brown fox jumps over the lazy dog. "), 100000)
+
+	var buffer bytes.Buffer
+	_, err := ParallelWriteFile(&buffer, testFileHeader, bytes.NewReader(source), ParallelOptions{BlockSize: 4096, Workers: 4})
+	if err != nil {
+		t.Error(err)
+	}
+
+	handle, err := ReadFile(bytes.NewReader(buffer.Bytes()))
+	if err != nil {
+		t.Error(err)
+	}
+	if handle.Header != testFileHeader {
+		t.Error("header does not match")
+	}
+	handle.SetReadMode(DecompressReadMode)
+	data, err := ioutil.ReadAll(handle)
+	if err != nil {
+		t.Error(err)
+	}
+	if !bytes.Equal(data, source) {
+		t.Error("decompressed contents did not round-trip through ParallelWriteFile")
+	}
+}
+
+func TestParallelWriteFileEmpty(t *testing.T) {
+	var buffer bytes.Buffer
+	if _, err := ParallelWriteFile(&buffer, testFileHeader, bytes.NewReader(nil), ParallelOptions{BlockSize: 4096, Workers: 4}); err != nil {
+		t.Error(err)
+	}
+
+	handle, err := ReadFile(bytes.NewReader(buffer.Bytes()))
+	if err != nil {
+		t.Error(err)
+	}
+	handle.SetReadMode(DecompressReadMode)
+	data, err := ioutil.ReadAll(handle)
+	if err != nil {
+		t.Error(err)
+	}
+	if len(data) != 0 {
+		t.Error("expected an empty body, got:", data)
+	}
+}
+
+// erroringWriter fails once at least limit bytes have been written to it in total, simulating a
+// client disconnecting partway through an upload.
+type erroringWriter struct {
+	limit, written int
+}
+
+var errWriteFailed = fmt.Errorf("erroringWriter: simulated write failure")
+
+func (w *erroringWriter) Write(p []byte) (int, error) {
+	if w.written >= w.limit {
+		return 0, errWriteFailed
+	}
+	w.written += len(p)
+	return len(p), nil
+}
+
+func TestParallelWriteFileWriteErrorDoesNotLeakGoroutines(t *testing.T) {
+	before := runtime.NumGoroutine()
+
+	source := bytes.Repeat([]byte("the quick brown fox jumps over the lazy dog. "), 100000)
+	_, err := ParallelWriteFile(&erroringWriter{limit: 1024}, testFileHeader, bytes.NewReader(source), ParallelOptions{BlockSize: 4096, Workers: 4})
+	if err != errWriteFailed {
+		t.Error("expected errWriteFailed from the draining loop, got:", err)
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for runtime.NumGoroutine() > before && time.Now().Before(deadline) {
+		runtime.Gosched()
+	}
+	if after := runtime.NumGoroutine(); after > before {
+		t.Errorf("goroutines leaked after a write error: before=%d after=%d", before, after)
+	}
+}
+
 func TestBadRead(t *testing.T) {
 	badData := make([]byte, 128)
 	_, err := ReadFile(bytes.NewReader(badData))
@@ -87,6 +470,17 @@ func TestRandomGenerating(t *testing.T) {
 	}
 }
 
+func TestNameGeneratorDeterministic(t *testing.T) {
+	const want = "test"
+	seed := []byte{15, 4, 14, 15} // indexes into charset spelling out "test", with no rejected bytes
+	gen := NewNameGenerator(charset, bytes.NewReader(seed))
+
+	got := gen.Generate(len(want))
+	if got != want {
+		t.Error("expected a deterministic reader to produce a deterministic name:", got)
+	}
+}
+
 func BenchmarkWrite(b *testing.B) {
 	encodedInfo, err := os.Stat("test_data/encoded")
 	if err != nil {
@@ -106,6 +500,21 @@ func BenchmarkWrite(b *testing.B) {
 	}
 }
 
+func BenchmarkParallelWrite(b *testing.B) {
+	for _, size := range []int{1 << 20, 4 << 20, 16 << 20} {
+		source := bytes.Repeat([]byte("0123456789abcdef"), size/16)
+		b.Run(fmt.Sprintf("%dMiB", size>>20), func(b *testing.B) {
+			b.SetBytes(int64(size))
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				var buffer bytes.Buffer
+				buffer.Grow(size)
+				ParallelWriteFile(&buffer, testFileHeader, bytes.NewReader(source), ParallelOptions{})
+			}
+		})
+	}
+}
+
 func BenchmarkRead(b *testing.B) {
 	rawInfo, err := os.Stat("test_data/raw")
 	if err != nil {
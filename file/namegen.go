@@ -0,0 +1,65 @@
+package file
+
+import (
+	"crypto/rand"
+	"io"
+)
+
+// Generates random strings drawn from a charset, reading entropy from an io.Reader. Unlike
+// seeding math/rand globally, each NameGenerator pulls directly from its own reader - normally
+// crypto/rand.Reader - so the names it produces (used as public URLs) aren't predictable.
+type NameGenerator struct {
+	charset string
+	reader  io.Reader
+	// The largest multiple of len(charset) at or below 256. Bytes read from reader that are
+	// >= this are discarded (rejection sampling) so that byte%len(charset) maps uniformly onto
+	// the charset instead of favoring its first few characters.
+	limit int
+}
+
+// Builds a NameGenerator that maps bytes read from reader onto charset via rejection sampling.
+// Passing a deterministic reader (e.g. a fixed bytes.Reader) makes the output reproducible for
+// tests.
+func NewNameGenerator(charset string, reader io.Reader) *NameGenerator {
+	n := len(charset)
+	return &NameGenerator{
+		charset: charset,
+		reader:  reader,
+		limit:   256 - (256 % n),
+	}
+}
+
+// Returns a random string of the given length built from the generator's charset. Each read
+// fetches one byte for every character still outstanding in a single call, so further reads
+// happen only to replace bytes discarded as biased, rather than one recursive call per character.
+func (g *NameGenerator) Generate(length int) string {
+	if length <= 0 {
+		return ""
+	}
+
+	out := make([]byte, length)
+	buf := make([]byte, length)
+	filled := 0
+	for filled < length {
+		chunk := buf[:length-filled]
+		if _, err := io.ReadFull(g.reader, chunk); err != nil {
+			panic(err)
+		}
+		for _, b := range chunk {
+			if int(b) >= g.limit {
+				continue
+			}
+			out[filled] = g.charset[int(b)%len(g.charset)]
+			filled++
+		}
+	}
+	return string(out)
+}
+
+// The generator used by CreateRandomFileName.
+var defaultNameGenerator = NewNameGenerator(charset, rand.Reader)
+
+// Returns a random string that's good for human URLs.
+func CreateRandomFileName(length int) string {
+	return defaultNameGenerator.Generate(length)
+}
@@ -0,0 +1,227 @@
+package file
+
+import (
+	"bytes"
+	"compress/gzip"
+	"container/heap"
+	"fmt"
+	"io"
+	"runtime"
+	"sync"
+)
+
+const defaultParallelBlockSize = 1 << 20 // 1 MiB
+
+// Options controlling how ParallelWriteFile splits and compresses a body.
+type ParallelOptions struct {
+	// Size of each block compressed independently. Defaults to 1 MiB (defaultParallelBlockSize)
+	// when zero.
+	BlockSize int
+	// Number of worker goroutines compressing blocks concurrently. Defaults to
+	// runtime.NumCPU() when zero.
+	Workers int
+}
+
+// One block of ParallelWriteFile's compressed output, tagged with its position in src so the
+// blocks can be reassembled in order regardless of which worker finishes first.
+type compressedBlock struct {
+	index int
+	data  []byte
+}
+
+// A container/heap.Interface min-heap of compressedBlock ordered by index, used to serialize
+// ParallelWriteFile's results back to dst in submission order as soon as they're contiguous.
+type blockHeap []compressedBlock
+
+func (h blockHeap) Len() int           { return len(h) }
+func (h blockHeap) Less(i, j int) bool { return h[i].index < h[j].index }
+func (h blockHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+
+func (h *blockHeap) Push(x interface{}) {
+	*h = append(*h, x.(compressedBlock))
+}
+
+func (h *blockHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	item := old[n-1]
+	*h = old[:n-1]
+	return item
+}
+
+// Writes a file the same way WriteFile does, but compresses the body as independent fixed-size
+// gzip members spread across a worker pool instead of a single streaming gzip.Writer. gzip is
+// defined to decode concatenated members as one stream, so ReadFile/SetReadMode need no changes
+// to read the result back - only the write path changes, spending roughly totalTime/opts.Workers
+// on large uploads instead of bottlenecking on a single CPU.
+//
+// Unlike WriteFile, the header is written to dst before the body is read (so writing can start
+// streaming right away), which means info.Checksum can't be computed in time: the written file
+// never carries a checksum, and DecompressReadMode skips verification for it the same way it does
+// for files written before the Checksum field existed.
+//
+// info.Method must be MethodGzip and info.Encryption must be EncryptionNone; other codecs aren't
+// guaranteed to support concatenated members, and WriteEncryptedFile covers encrypted writes.
+//
+// An empty src still produces one (empty) gzip member, so the result is always a validly
+// readable file, matching what WriteFile guarantees for an empty body.
+func ParallelWriteFile(dst io.Writer, info FileHeader, src io.Reader, opts ParallelOptions) (nWritten int, err error) {
+	if dst == nil || src == nil {
+		err = fmt.Errorf("you must provide a non nil dst and src")
+		return
+	}
+	if info.Encryption != EncryptionNone {
+		err = fmt.Errorf("use WriteEncryptedFile to write a FileHeader with Encryption set")
+		return
+	}
+	if info.Method != MethodGzip {
+		err = fmt.Errorf("ParallelWriteFile only supports MethodGzip")
+		return
+	}
+
+	blockSize := opts.BlockSize
+	if blockSize <= 0 {
+		blockSize = defaultParallelBlockSize
+	}
+	workers := opts.Workers
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+
+	n, err := writeHeader(dst, info)
+	if err != nil {
+		return
+	}
+	nWritten += n
+
+	type rawBlock struct {
+		index int
+		data  []byte
+	}
+
+	rawBlocks := make(chan rawBlock)
+	results := make(chan compressedBlock)
+
+	// done tells the producer and workers below to give up as soon as the draining loop returns
+	// early (a dst.Write error or a worker compression failure), so a write/compress failure can't
+	// leave goroutines blocked forever on these unbuffered channels.
+	done := make(chan struct{})
+	var closeDone sync.Once
+	cancel := func() { closeDone.Do(func() { close(done) }) }
+	defer cancel()
+
+	var readErr error
+	go func() {
+		defer close(rawBlocks)
+		wroteAny := false
+		for index := 0; ; index++ {
+			buf := make([]byte, blockSize)
+			read, e := io.ReadFull(src, buf)
+			if read > 0 {
+				wroteAny = true
+				select {
+				case rawBlocks <- rawBlock{index: index, data: buf[:read]}:
+				case <-done:
+					return
+				}
+			}
+			if e == io.EOF || e == io.ErrUnexpectedEOF {
+				if !wroteAny {
+					// src was empty: still emit one (empty) block so the output is a valid,
+					// readable gzip stream, same as WriteFile guarantees for an empty body.
+					select {
+					case rawBlocks <- rawBlock{index: 0, data: nil}:
+					case <-done:
+					}
+				}
+				return
+			}
+			if e != nil {
+				readErr = e
+				return
+			}
+		}
+	}()
+
+	var workerErrMu sync.Mutex
+	var workerErr error
+	var wg sync.WaitGroup
+	wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go func() {
+			defer wg.Done()
+			for {
+				var block rawBlock
+				var ok bool
+				select {
+				case block, ok = <-rawBlocks:
+					if !ok {
+						return
+					}
+				case <-done:
+					return
+				}
+
+				var compressed bytes.Buffer
+				gz := gzip.NewWriter(&compressed)
+				_, werr := gz.Write(block.data)
+				if werr == nil {
+					werr = gz.Flush()
+				}
+				if werr == nil {
+					werr = gz.Close()
+				}
+				if werr != nil {
+					workerErrMu.Lock()
+					if workerErr == nil {
+						workerErr = werr
+					}
+					workerErrMu.Unlock()
+					cancel()
+					return
+				}
+
+				select {
+				case results <- compressedBlock{index: block.index, data: compressed.Bytes()}:
+				case <-done:
+					return
+				}
+			}
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+
+	pending := &blockHeap{}
+	heap.Init(pending)
+	nextIndex := 0
+	for block := range results {
+		heap.Push(pending, block)
+		for pending.Len() > 0 && (*pending)[0].index == nextIndex {
+			next := heap.Pop(pending).(compressedBlock)
+			var n int
+			n, err = dst.Write(next.data)
+			nWritten += n
+			if err != nil {
+				cancel()
+				return
+			}
+			nextIndex++
+		}
+	}
+
+	if err == nil {
+		workerErrMu.Lock()
+		we := workerErr
+		workerErrMu.Unlock()
+		switch {
+		case we != nil:
+			err = we
+		case readErr != nil:
+			err = readErr
+		}
+	}
+	return
+}